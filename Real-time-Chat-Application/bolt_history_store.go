@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltHistoryStore persists per-topic history to a BoltDB file so it
+// survives a server restart, at the cost of a disk write per message.
+// Each topic gets its own bucket; keys are the message ID as an 8-byte
+// big-endian integer, which keeps bucket iteration in ID order.
+type boltHistoryStore struct {
+	db   *bolt.DB
+	size int
+}
+
+func newBoltHistoryStore(path string, size int) (*boltHistoryStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &boltHistoryStore{db: db, size: size}, nil
+}
+
+func (s *boltHistoryStore) Append(msg Message) {
+	s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(msg.Topic))
+		if err != nil {
+			return err
+		}
+		raw, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(idKey(msg.ID), raw); err != nil {
+			return err
+		}
+		return trimBucket(bucket, s.size)
+	})
+}
+
+func (s *boltHistoryStore) Since(topic string, sinceID uint64) []Message {
+	var out []Message
+	s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(topic))
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.Seek(idKey(sinceID + 1)); k != nil; k, v = cursor.Next() {
+			var msg Message
+			if json.Unmarshal(v, &msg) == nil {
+				out = append(out, msg)
+			}
+		}
+		return nil
+	})
+	return out
+}
+
+func (s *boltHistoryStore) Last(topic string, n int) []Message {
+	var out []Message
+	s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(topic))
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.Last(); k != nil && (n <= 0 || len(out) < n); k, v = cursor.Prev() {
+			var msg Message
+			if json.Unmarshal(v, &msg) == nil {
+				out = append(out, msg)
+			}
+		}
+		for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+			out[i], out[j] = out[j], out[i]
+		}
+		return nil
+	})
+	return out
+}
+
+// trimBucket deletes the oldest entries in bucket until at most size remain.
+func trimBucket(bucket *bolt.Bucket, size int) error {
+	if size <= 0 {
+		return nil
+	}
+	cursor := bucket.Cursor()
+	count := 0
+	for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+		count++
+	}
+	excess := count - size
+	cursor = bucket.Cursor()
+	for k, _ := cursor.First(); excess > 0 && k != nil; k, _ = cursor.Next() {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+		excess--
+	}
+	return nil
+}
+
+func idKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Broker decouples topic fan-out from the in-process client registry so the
+// Hub can run standalone or, when multiple server instances sit behind a
+// load balancer, have a message received on one instance delivered to
+// subscribers connected to another.
+type Broker interface {
+	// Publish sends msg to every current Subscribe-r of topic, on this
+	// process and, for distributed backends, every other one.
+	Publish(topic string, msg []byte) error
+	// Subscribe returns a channel that receives messages Published to topic
+	// from here on; localBroker drops a message for a subscriber whose
+	// channel is full. The channel is never closed by the broker.
+	Subscribe(topic string) (<-chan []byte, error)
+}
+
+// BrokerBackend selects which Broker implementation newBroker constructs.
+type BrokerBackend string
+
+const (
+	BackendMemory BrokerBackend = "memory" // Default: single-process, in-memory fan-out.
+	BackendRedis  BrokerBackend = "redis"  // Redis PUB/SUB, for horizontal scaling.
+	BackendNATS   BrokerBackend = "nats"   // NATS core pub/sub, alternative to Redis.
+)
+
+// BrokerConfig selects a Broker backend and its connection details.
+type BrokerConfig struct {
+	Backend   BrokerBackend
+	RedisAddr string // host:port, used when Backend == BackendRedis.
+	NATSURL   string // e.g. nats://127.0.0.1:4222, used when Backend == BackendNATS.
+}
+
+// defaultBrokerConfig runs everything in-process, suitable for a single
+// server instance and for local development.
+func defaultBrokerConfig() BrokerConfig {
+	return BrokerConfig{Backend: BackendMemory}
+}
+
+// newBroker constructs the Broker selected by cfg.Backend.
+func newBroker(cfg BrokerConfig) (Broker, error) {
+	switch cfg.Backend {
+	case "", BackendMemory:
+		return newLocalBroker(), nil
+	case BackendRedis:
+		return newRedisBroker(cfg.RedisAddr), nil
+	case BackendNATS:
+		return newNATSBroker(cfg.NATSURL)
+	default:
+		return nil, fmt.Errorf("unknown broker backend %q", cfg.Backend)
+	}
+}
+
+// localBroker fans messages out to in-process subscriber channels. It is
+// the Broker used when the server runs as a single instance.
+type localBroker struct {
+	mu   sync.Mutex
+	subs map[string][]chan []byte
+}
+
+func newLocalBroker() *localBroker {
+	return &localBroker{subs: make(map[string][]chan []byte)}
+}
+
+func (b *localBroker) Publish(topic string, msg []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.subs[topic] {
+		select {
+		case ch <- msg:
+		default: // Slow subscriber; drop rather than block the publisher.
+		}
+	}
+	return nil
+}
+
+func (b *localBroker) Subscribe(topic string) (<-chan []byte, error) {
+	ch := make(chan []byte, 64)
+	b.mu.Lock()
+	b.subs[topic] = append(b.subs[topic], ch)
+	b.mu.Unlock()
+	return ch, nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// Client represents a single chatting user.
+type Client struct {
+	conn          *websocket.Conn // The WebSocket connection.
+	send          chan []byte     // Buffered channel of outbound messages.
+	closeOnce     sync.Once       // Guards send so it's only ever closed once.
+	id            uuid.UUID       // Server-assigned, stable identity for this connection.
+	name          string          // Display name; untrusted, never used to address a client.
+	cfg           Config          // Pump timings for this client's connection.
+	initialTopics []string        // Topics requested at connect time, via ?topics=.
+	topics        map[string]bool // Topics this client is currently subscribed to; guarded by Hub.mu.
+}
+
+// close closes send. The hub can reach a client through several paths
+// (normal unregister, a full send buffer in the topic fan-out, a full
+// buffer on a direct message), so this is safe to call more than once.
+func (c *Client) close() {
+	c.closeOnce.Do(func() {
+		close(c.send)
+	})
+}
+
+// controlMessage is the envelope a client sends to subscribe to or leave a
+// topic. Anything that isn't one of these types is treated as a chat post.
+type controlMessage struct {
+	Type  string `json:"type"`
+	Topic string `json:"topic"`
+}
+
+// inboundChat is the envelope a client sends to post a message. Type is
+// "dm" for a direct message (To must be a registered client ID) and
+// anything else is treated as a topic chat post. Any sender/ID the client
+// supplies is ignored; the server stamps its own.
+type inboundChat struct {
+	Type    string `json:"type"`
+	Topic   string `json:"topic"`
+	To      string `json:"to"`
+	Content string `json:"content"`
+}
+
+// readPump pumps messages from the WebSocket connection to the hub.
+// The application runs readPump in a per-connection goroutine. The application
+// ensures that there is at most one reader on a connection by executing all
+// reads from this goroutine.
+func (c *Client) readPump(hub *Hub) {
+	defer func() { // Ensure cleanup on exit
+		hub.unregister <- c
+		c.conn.Close()
+		log.Printf("Connection closed for readPump: %s", c.conn.RemoteAddr())
+	}()
+	// Set a read limit to prevent excessively large messages.
+	c.conn.SetReadLimit(c.cfg.MaxMessageSize)
+	// A client that never sends a pong within PongWait is considered dead;
+	// seed the deadline now and push it out again on every pong.
+	c.conn.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
+	c.conn.SetPongHandler(func(string) error {
+		log.Printf("Pong received from %s", c.conn.RemoteAddr())
+		return c.conn.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
+	})
+
+	for {
+		// ReadMessage blocks until a message is received or an error occurs.
+		// It returns the message type (e.g., TextMessage, BinaryMessage),
+		// the message payload (as []byte), and an error.
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("error: %v", err)
+			}
+			log.Printf("Read error from client %s: %v", c.conn.RemoteAddr(), err)
+			break // Exit loop, which triggers the defer to unregister and close
+		}
+
+		var ctrl controlMessage
+		if err := json.Unmarshal(message, &ctrl); err == nil {
+			switch ctrl.Type {
+			case "subscribe":
+				hub.subscribe <- subscription{client: c, topic: ctrl.Topic}
+				continue
+			case "unsubscribe":
+				hub.unsubscribe <- subscription{client: c, topic: ctrl.Topic}
+				continue
+			}
+		}
+
+		var chat inboundChat
+		json.Unmarshal(message, &chat)
+
+		if chat.Type == "dm" {
+			target, err := uuid.Parse(chat.To)
+			if err != nil {
+				log.Printf("Dropping dm from %s: invalid target %q", c.id, chat.To)
+				continue
+			}
+			raw, _ := json.Marshal(Message{
+				Type:    "dm",
+				Sender:  c.id.String(),
+				To:      chat.To,
+				Content: chat.Content,
+			})
+			hub.direct <- directMessage{to: target, payload: raw}
+			continue
+		}
+
+		formattedMsg, _ := json.Marshal(Message{
+			Type:    "chat",
+			Sender:  c.id.String(),
+			Content: chat.Content,
+			Topic:   chat.Topic,
+		})
+
+		log.Printf("Received message from %s on %q: %s", c.id, chat.Topic, string(formattedMsg))
+		hub.broadcast <- formattedMsg // Send the received message to the hub's broadcast channel.
+	}
+}
+
+// writePump pumps messages from the hub to the WebSocket connection.
+// A goroutine running writePump is started for each connection. The
+// application ensures that there is at most one writer to a connection by
+// executing all writes from this goroutine.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(c.cfg.PingPeriod)
+	defer func() { // Ensure cleanup on exit
+		ticker.Stop()
+		c.conn.Close() // Close the WebSocket connection
+		log.Printf("Connection closed for writePump: %s", c.conn.RemoteAddr())
+	}()
+	for {
+		select {
+		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteWait))
+			if !ok {
+				// The hub closed the channel.
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				log.Printf("Hub closed channel for client %s", c.conn.RemoteAddr())
+				return
+			}
+
+			// Use NextWriter so that any additional messages already queued
+			// in c.send are coalesced into the same websocket frame instead
+			// of each triggering its own write.
+			w, err := c.conn.NextWriter(websocket.TextMessage)
+			if err != nil {
+				log.Printf("Write error to client %s: %v", c.conn.RemoteAddr(), err)
+				return
+			}
+			w.Write(message)
+
+			n := len(c.send)
+			for i := 0; i < n; i++ {
+				w.Write([]byte{'\n'})
+				w.Write(<-c.send)
+			}
+
+			if err := w.Close(); err != nil {
+				log.Printf("Write error to client %s: %v", c.conn.RemoteAddr(), err)
+				return
+			}
+			log.Printf("Sent message to %s: %s", c.conn.RemoteAddr(), string(message))
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				log.Printf("Ping error to client %s: %v", c.conn.RemoteAddr(), err)
+				return
+			}
+		}
+	}
+}
+
+// replayHistory pushes the history a client asked for onto its send
+// channel. A reconnecting client passes either ?since=<last seen message
+// ID> to resume exactly where it left off, or ?last=<n> to just get the
+// n most recent messages; neither is required.
+func replayHistory(hub *Hub, client *Client, query url.Values) {
+	if len(client.initialTopics) == 0 {
+		return
+	}
+
+	var since *uint64
+	if raw := query.Get("since"); raw != "" {
+		if id, err := strconv.ParseUint(raw, 10, 64); err == nil {
+			since = &id
+		}
+	}
+	var last int
+	if raw := query.Get("last"); raw != "" {
+		last, _ = strconv.Atoi(raw)
+	}
+	if since == nil && last == 0 {
+		return
+	}
+
+	for _, topic := range client.initialTopics {
+		var history []Message
+		if since != nil {
+			history = hub.history.Since(topic, *since)
+		} else {
+			history = hub.history.Last(topic, last)
+		}
+		for _, msg := range history {
+			raw, err := json.Marshal(msg)
+			if err != nil {
+				continue
+			}
+			select {
+			case client.send <- raw:
+			default:
+			}
+		}
+	}
+}
+
+// serveWs handles websocket requests from the peer.
+func serveWs(hub *Hub, cfg Config, srvCfg ServerConfig, upgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Request) {
+	log.Println("New WebSocket connection attempt...")
+	// Get the client's name from query parameter
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = "Anonymous"
+	}
+
+	// Upgrade upgrades the HTTP server connection to the WebSocket protocol.
+	conn, err := upgrader.Upgrade(w, r, nil) // The third argument is response headers, nil for now.
+	if err != nil {
+		log.Printf("Failed to upgrade to WebSocket: %v", err)
+		return
+	}
+	conn.EnableWriteCompression(true)
+	conn.SetCompressionLevel(srvCfg.CompressionLevel)
+	log.Printf("WebSocket connection established: %s (subprotocol %q)", conn.RemoteAddr(), conn.Subprotocol())
+
+	var initialTopics []string
+	if raw := r.URL.Query().Get("topics"); raw != "" {
+		for _, topic := range strings.Split(raw, ",") {
+			if topic != "" {
+				initialTopics = append(initialTopics, topic)
+			}
+		}
+	}
+
+	// Create a new client, identified by a server-assigned UUID so that
+	// clients can never spoof or collide with each other's identity.
+	client := &Client{
+		conn:          conn,
+		send:          make(chan []byte, 256),
+		id:            uuid.New(),
+		name:          name,
+		cfg:           cfg,
+		initialTopics: initialTopics,
+		topics:        make(map[string]bool),
+	}
+
+	// Replay missed history for each requested topic before the client is
+	// registered, so it can't race with messages arriving on the live path.
+	replayHistory(hub, client, r.URL.Query())
+
+	hub.register <- client // Register the new client with the hub
+
+	// Allow collection of memory referenced by the go router potentially.
+	// Start the read and write pumps as separate goroutines.
+	// This allows concurrent reading and writing for this client.
+	go client.writePump()
+	go client.readPump(hub) // Pass the hub to readPump so it can send messages to the hub
+}
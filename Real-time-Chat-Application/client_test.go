@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestChatSenderCannotBeSpoofed verifies that a client can't put words in
+// someone else's mouth by including its own "sender" in the JSON it sends:
+// readPump only ever reads Type/Topic/To/Content off the client payload (see
+// inboundChat), so the Sender on the resulting broadcast is always the
+// server-assigned client ID, never whatever the client included.
+func TestChatSenderCannotBeSpoofed(t *testing.T) {
+	hub := newHub(defaultConfig(), newLocalBroker(), newRingHistoryStore(defaultHistorySize))
+	go hub.run()
+	go hub.runPublisher()
+
+	upgrader := newUpgrader(ServerConfig{AllowInsecureOrigin: true})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, defaultConfig(), ServerConfig{}, upgrader, w, r)
+	}))
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?topics=general"
+
+	attacker, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dial attacker: %v", err)
+	}
+	defer attacker.Close()
+
+	// Connect after the attacker so it observes the attacker's chat post,
+	// not the other way around.
+	listener, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dial listener: %v", err)
+	}
+	defer listener.Close()
+
+	const spoofed = "mallory"
+	payload := `{"type":"chat","topic":"general","sender":"` + spoofed + `","content":"hi"}`
+	if err := attacker.WriteMessage(websocket.TextMessage, []byte(payload)); err != nil {
+		t.Fatalf("write from attacker: %v", err)
+	}
+
+	listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var got Message
+	for {
+		_, raw, err := listener.ReadMessage()
+		if err != nil {
+			t.Fatalf("read from listener: %v", err)
+		}
+		if json.Unmarshal(raw, &got) == nil && got.Type == "chat" {
+			break
+		}
+	}
+
+	if got.Sender == spoofed {
+		t.Fatalf("Sender was not overwritten server-side: got %q", got.Sender)
+	}
+	if got.Content != "hi" {
+		t.Fatalf("Content = %q, want %q", got.Content, "hi")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// topicsHandler exposes the hub's topics over HTTP so external services can
+// list active rooms or inject messages without opening a websocket.
+//
+//	GET  /topics                 -> {"topics": [...]}
+//	POST /topics/{name}/publish  -> publish a message onto {name}
+func topicsHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/topics")
+		path = strings.Trim(path, "/")
+
+		if path == "" {
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string][]string{"topics": hub.topicNames()})
+			return
+		}
+
+		topic, action, ok := strings.Cut(path, "/")
+		if !ok || action != "publish" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var body struct {
+			Content string `json:"content"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := hub.publish(topic, body.Content); err != nil {
+			http.Error(w, "failed to publish message", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// historyHandler exposes stored topic history to plain HTTP polling
+// clients, mirroring the replay a websocket client gets via ?since=/?last=.
+//
+//	GET /history?topic=...&since=<id>
+//	GET /history?topic=...&last=<n>
+func historyHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		topic := r.URL.Query().Get("topic")
+		if topic == "" {
+			http.Error(w, "topic is required", http.StatusBadRequest)
+			return
+		}
+
+		var messages []Message
+		if raw := r.URL.Query().Get("since"); raw != "" {
+			since, err := strconv.ParseUint(raw, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid since", http.StatusBadRequest)
+				return
+			}
+			messages = hub.history.Since(topic, since)
+		} else {
+			last, _ := strconv.Atoi(r.URL.Query().Get("last"))
+			messages = hub.history.Last(topic, last)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]Message{"messages": messages})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// defaultHistorySize is the number of messages retained per topic when no
+// other size is configured.
+const defaultHistorySize = 200
+
+// HistoryStore retains a bounded amount of per-topic message history so
+// reconnecting clients can resume where they left off instead of only
+// seeing messages sent after they reconnect.
+type HistoryStore interface {
+	// Append records msg, which must already have ID and Timestamp set.
+	Append(msg Message)
+	// Since returns, oldest first, every stored message on topic with an ID
+	// greater than sinceID.
+	Since(topic string, sinceID uint64) []Message
+	// Last returns, oldest first, up to the n most recent stored messages
+	// on topic.
+	Last(topic string, n int) []Message
+}
+
+// HistoryBackend selects which HistoryStore implementation newHistoryStore
+// constructs.
+type HistoryBackend string
+
+const (
+	HistoryMemory HistoryBackend = "memory" // Default: in-memory ring buffer, lost on restart.
+	HistoryBolt   HistoryBackend = "bolt"   // BoltDB-backed, durable across restarts.
+)
+
+// HistoryConfig selects a HistoryStore backend and its settings.
+type HistoryConfig struct {
+	Backend  HistoryBackend
+	Size     int    // Messages retained per topic.
+	BoltPath string // Path to the BoltDB file, used when Backend == HistoryBolt.
+}
+
+// defaultHistoryConfig keeps history in memory, bounded to defaultHistorySize
+// messages per topic.
+func defaultHistoryConfig() HistoryConfig {
+	return HistoryConfig{Backend: HistoryMemory, Size: defaultHistorySize}
+}
+
+// newHistoryStore constructs the HistoryStore selected by cfg.Backend.
+func newHistoryStore(cfg HistoryConfig) (HistoryStore, error) {
+	size := cfg.Size
+	if size <= 0 {
+		size = defaultHistorySize
+	}
+	switch cfg.Backend {
+	case "", HistoryMemory:
+		return newRingHistoryStore(size), nil
+	case HistoryBolt:
+		return newBoltHistoryStore(cfg.BoltPath, size)
+	default:
+		return nil, fmt.Errorf("unknown history backend %q", cfg.Backend)
+	}
+}
+
+// ringHistoryStore keeps the last size messages per topic in memory.
+type ringHistoryStore struct {
+	mu      sync.Mutex
+	size    int
+	history map[string][]Message // Oldest first, capped at size.
+}
+
+func newRingHistoryStore(size int) *ringHistoryStore {
+	return &ringHistoryStore{size: size, history: make(map[string][]Message)}
+}
+
+func (s *ringHistoryStore) Append(msg Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buf := append(s.history[msg.Topic], msg)
+	if len(buf) > s.size {
+		buf = buf[len(buf)-s.size:]
+	}
+	s.history[msg.Topic] = buf
+}
+
+func (s *ringHistoryStore) Since(topic string, sinceID uint64) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Message
+	for _, msg := range s.history[topic] {
+		if msg.ID > sinceID {
+			out = append(out, msg)
+		}
+	}
+	return out
+}
+
+func (s *ringHistoryStore) Last(topic string, n int) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buf := s.history[topic]
+	if n <= 0 || n > len(buf) {
+		n = len(buf)
+	}
+	out := make([]Message, n)
+	copy(out, buf[len(buf)-n:])
+	return out
+}
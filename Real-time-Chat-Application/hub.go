@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Message IDs are stamped Snowflake-style: a millisecond timestamp in the
+// high bits, then this instance's ID, then a sequence for IDs minted within
+// the same millisecond. Every instance in a horizontally scaled deployment
+// (chunk0-5) runs startFanOut for every topic it has local subscribers on
+// and records history locally,
+// so IDs must sort consistently across instances, not just be unique; a
+// purely random per-instance tag OR'd over a per-instance counter (this
+// scheme's predecessor) meant ordering was dominated by the random bits
+// instead of time, so Since(topic, cursor) could silently drop a message
+// from one instance that arrived after the client's cursor from another.
+const (
+	instanceIDBits = 10                        // Bits reserved for the instance ID.
+	sequenceBits   = 12                        // Bits reserved for the same-millisecond sequence.
+	instanceIDMax  = 1<<instanceIDBits - 1
+	sequenceMax    = 1<<sequenceBits - 1
+)
+
+// idEpoch anchors the millisecond timestamp packed into message IDs so the
+// remaining high bits don't run out for decades; it has no other meaning.
+var idEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newInstanceID draws a random instanceIDBits-wide value identifying this
+// instance in message IDs it stamps.
+func newInstanceID() uint64 {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// No entropy source; IDs stay ordered within this instance but may
+		// collide with another instance's. Better than failing to start.
+		return 0
+	}
+	return uint64(binary.BigEndian.Uint16(b[:])) & instanceIDMax
+}
+
+// Message is the wire format for both chat traffic and hub-published
+// messages. Type discriminates what kind of event this is; Sender is always
+// set server-side (a client ID, or "system" for messages injected through
+// Hub.publish), and To is a registered client ID. ID and
+// Timestamp are assigned server-side when a chat message is broadcast, so
+// they can be used as a cursor to replay history on reconnect.
+type Message struct {
+	Type      string `json:"type"` // "chat", "join", "leave", "presence", or "dm".
+	ID        uint64 `json:"id,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"` // Unix millis.
+	Sender    string `json:"sender"`
+	To        string `json:"to,omitempty"` // Recipient client ID, set only for "dm".
+	Content   string `json:"content"`
+	Topic     string `json:"topic,omitempty"`
+}
+
+// subscription pairs a client with the topic it wants to join or leave.
+type subscription struct {
+	client *Client
+	topic  string
+}
+
+// directMessage is a pre-encoded Message destined for exactly one client.
+type directMessage struct {
+	to      uuid.UUID
+	payload []byte
+}
+
+// publishJob pairs a topic with an already-encoded payload, queued for
+// runPublisher so a slow or unreachable Broker can't stall run().
+type publishJob struct {
+	topic   string
+	payload []byte
+}
+
+// Hub maintains the set of active clients, grouped by topic, plus a
+// registry keyed by stable client ID, and routes messages between them.
+type Hub struct {
+	clients      map[string]map[*Client]bool // Registered clients, keyed by topic.
+	byID         map[uuid.UUID]*Client       // Registered clients, keyed by server-assigned ID.
+	broadcast    chan []byte                 // Inbound topic messages from the clients.
+	direct       chan directMessage          // Inbound direct messages from the clients.
+	register     chan *Client                // Register requests from the clients.
+	unregister   chan *Client                // Unregister requests from clients.
+	subscribe    chan subscription           // Subscribe requests from the clients.
+	unsubscribe  chan subscription           // Unsubscribe requests from the clients.
+	publishQueue chan publishJob             // Buffered; drained by runPublisher, off the run() goroutine.
+	mu           sync.Mutex                  // For thread-safe access to clients/byID maps
+	cfg          Config                      // Pump timings passed to newHub; clients take theirs from serveWs, not from here.
+	broker       Broker                      // Transport used to fan topic messages out across instances.
+	history      HistoryStore                // Bounded per-topic message history, for replay on reconnect.
+	instanceID   uint64                      // This instance's tag in IDs it stamps; see newInstanceID.
+	lastIDMillis int64                       // idEpoch-relative millisecond of the last ID stamped, for sequence rollover.
+	idSequence   uint64                      // Sequence within lastIDMillis; see nextMessageID.
+}
+
+func newHub(cfg Config, broker Broker, history HistoryStore) *Hub {
+	return &Hub{
+		broadcast:    make(chan []byte),
+		direct:       make(chan directMessage),
+		register:     make(chan *Client),
+		unregister:   make(chan *Client),
+		subscribe:    make(chan subscription),
+		unsubscribe:  make(chan subscription),
+		publishQueue: make(chan publishJob, 256),
+		clients:      make(map[string]map[*Client]bool),
+		byID:         make(map[uuid.UUID]*Client),
+		cfg:          cfg,
+		broker:       broker,
+		history:      history,
+		instanceID:   newInstanceID(),
+	}
+}
+
+// nextMessageID stamps a Snowflake-style ID for a message about to be
+// published: the current idEpoch-relative millisecond in the high bits,
+// this instance's ID next, then a sequence to disambiguate IDs minted
+// within the same millisecond. Only called from run()'s single goroutine,
+// so the counters it updates need no synchronization of their own.
+func (h *Hub) nextMessageID() uint64 {
+	millis := time.Since(idEpoch).Milliseconds()
+	if millis <= h.lastIDMillis {
+		h.idSequence = (h.idSequence + 1) & sequenceMax
+		if h.idSequence == 0 {
+			// Sequence exhausted for this millisecond; spin to the next one
+			// rather than reuse an ID.
+			for millis <= h.lastIDMillis {
+				millis = time.Since(idEpoch).Milliseconds()
+			}
+		}
+	} else {
+		h.idSequence = 0
+	}
+	h.lastIDMillis = millis
+	return uint64(millis)<<(instanceIDBits+sequenceBits) | h.instanceID<<sequenceBits | h.idSequence
+}
+
+// run is the heart of the Hub, managing client registrations,
+// topic subscriptions, and message routing.
+func (h *Hub) run() {
+	for {
+		select {
+		case client := <-h.register:
+			h.mu.Lock()
+			h.byID[client.id] = client
+			h.mu.Unlock()
+			log.Printf("Client registered: %s (%s)", client.id, client.conn.RemoteAddr())
+			for _, topic := range client.initialTopics {
+				h.addSubscriber(client, topic)
+			}
+		case client := <-h.unregister:
+			h.mu.Lock()
+			topics := make([]string, 0, len(client.topics))
+			for topic := range client.topics {
+				topics = append(topics, topic)
+			}
+			h.dropClient(client)
+			h.mu.Unlock()
+			for _, topic := range topics {
+				h.announce(client, "leave", topic)
+			}
+			log.Printf("Client unregistered: %s (%s)", client.id, client.conn.RemoteAddr())
+		case sub := <-h.subscribe:
+			h.addSubscriber(sub.client, sub.topic)
+		case sub := <-h.unsubscribe:
+			h.mu.Lock()
+			delete(h.clients[sub.topic], sub.client)
+			delete(sub.client.topics, sub.topic)
+			h.mu.Unlock()
+			log.Printf("Client %s unsubscribed from %q", sub.client.id, sub.topic)
+		case message := <-h.broadcast:
+			// Parse the message and stamp it with a server-assigned ID and
+			// timestamp, then queue it for the broker. Recording it in history
+			// and delivering it to local subscribers both happen in the
+			// per-topic fan-out goroutine started by addSubscriber, the same
+			// path used for messages published by other instances, so every
+			// instance's history stays complete regardless of which instance
+			// a message was sent on. A topic that has never had a local
+			// subscriber has no fan-out goroutine here, so its messages are
+			// not recorded on this instance.
+			var msg Message
+			if err := json.Unmarshal(message, &msg); err == nil {
+				msg.ID = h.nextMessageID()
+				msg.Timestamp = time.Now().UnixMilli()
+
+				stamped, err := json.Marshal(msg)
+				if err != nil {
+					continue
+				}
+				h.enqueuePublish(msg.Topic, stamped)
+			}
+		case dm := <-h.direct:
+			h.mu.Lock()
+			if target, ok := h.byID[dm.to]; ok {
+				select {
+				case target.send <- dm.payload:
+				default:
+					h.dropClient(target)
+					log.Printf("Client send buffer full or disconnected, removing: %s", target.conn.RemoteAddr())
+				}
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+// runPublisher drains publishQueue and hands each job to the broker. It runs
+// on its own goroutine, separate from run(), so a blocking or slow
+// Broker.Publish call (Redis/NATS under network trouble, for example) can't
+// stall client register/unregister/subscribe/direct handling.
+func (h *Hub) runPublisher() {
+	for job := range h.publishQueue {
+		if err := h.broker.Publish(job.topic, job.payload); err != nil {
+			log.Printf("Failed to publish to topic %q: %v", job.topic, err)
+		}
+	}
+}
+
+// enqueuePublish hands payload to runPublisher for topic, dropping it rather
+// than blocking run() if the queue is full; a stalled or slow broker must
+// never stall the rest of the hub.
+func (h *Hub) enqueuePublish(topic string, payload []byte) {
+	select {
+	case h.publishQueue <- publishJob{topic: topic, payload: payload}:
+	default:
+		log.Printf("Publish queue full, dropping message for topic %q", topic)
+	}
+}
+
+// dropClient removes client from every topic it belongs to and from the ID
+// registry, and closes its send channel. It is the single place that does
+// either of those things, so it's safe to call from any path that decides
+// a client is gone (normal unregister, or a full send buffer encountered
+// while fanning a message out) without risking a double close. Callers
+// must hold h.mu.
+func (h *Hub) dropClient(client *Client) {
+	for topic := range client.topics {
+		delete(h.clients[topic], client)
+	}
+	delete(h.byID, client.id)
+	client.close()
+}
+
+// addSubscriber joins client to topic, creating the topic's client set on
+// first use, and records the membership on the client so it can be torn
+// down on unregister. A "join" presence message is announced to the rest
+// of the topic's subscribers.
+func (h *Hub) addSubscriber(client *Client, topic string) {
+	h.mu.Lock()
+	firstSubscriber := h.clients[topic] == nil
+	if firstSubscriber {
+		h.clients[topic] = make(map[*Client]bool)
+	}
+	h.clients[topic][client] = true
+	client.topics[topic] = true
+	h.mu.Unlock()
+	log.Printf("Client %s subscribed to %q", client.id, topic)
+	h.announce(client, "join", topic)
+	if firstSubscriber {
+		h.startFanOut(topic)
+	}
+}
+
+// startFanOut subscribes to topic on the broker and delivers everything it
+// receives to the topic's current local subscribers, recording chat
+// messages in this instance's history store first (join/leave presence
+// isn't retained). It runs for the lifetime of the Hub once started; topics
+// are assumed to be a bounded, relatively stable set, so a single
+// long-lived goroutine per topic ever subscribed to is an acceptable
+// tradeoff against the complexity of tearing it down when the last local
+// subscriber leaves. Every instance in a horizontally scaled deployment runs
+// its own copy of this goroutine per topic, so both history and presence
+// stay complete on each instance regardless of which one a message or
+// announcement originated on.
+func (h *Hub) startFanOut(topic string) {
+	ch, err := h.broker.Subscribe(topic)
+	if err != nil {
+		log.Printf("Failed to subscribe broker to topic %q: %v", topic, err)
+		return
+	}
+	go func() {
+		for raw := range ch {
+			var msg Message
+			if err := json.Unmarshal(raw, &msg); err != nil {
+				continue
+			}
+			if msg.Type == "chat" {
+				h.history.Append(msg)
+			}
+			h.mu.Lock()
+			for client := range h.clients[topic] {
+				// Don't deliver the message back to its own sender.
+				if client.id.String() == msg.Sender {
+					continue
+				}
+				select {
+				case client.send <- raw:
+				default:
+					h.dropClient(client)
+					log.Printf("Client send buffer full or disconnected, removing: %s", client.conn.RemoteAddr())
+				}
+			}
+			h.mu.Unlock()
+		}
+	}()
+}
+
+// announce delivers a presence message for client's event (join/leave) on
+// topic to every other subscriber of that topic, including ones connected to
+// other instances: it's queued onto the broker through the same path chat
+// messages use (see enqueuePublish and startFanOut) rather than written
+// directly to this instance's local peers, which previously left join/leave
+// invisible to every instance but the one the client connected to.
+func (h *Hub) announce(client *Client, event, topic string) {
+	raw, err := json.Marshal(Message{Type: event, Sender: client.id.String(), Content: client.name, Topic: topic})
+	if err != nil {
+		return
+	}
+	h.enqueuePublish(topic, raw)
+}
+
+// publish injects a chat message onto a topic as if it had come from a
+// client, used by the HTTP publish endpoint to bridge external services
+// into the hub.
+func (h *Hub) publish(topic, content string) error {
+	raw, err := json.Marshal(Message{Type: "chat", Sender: "system", Topic: topic, Content: content})
+	if err != nil {
+		return err
+	}
+	h.broadcast <- raw
+	return nil
+}
+
+// topicNames returns the topics that currently have at least one subscriber.
+func (h *Hub) topicNames() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	names := make([]string, 0, len(h.clients))
+	for topic, subs := range h.clients {
+		if len(subs) > 0 {
+			names = append(names, topic)
+		}
+	}
+	return names
+}
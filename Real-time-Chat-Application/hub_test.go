@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestMessageIDOrderingAcrossInstances verifies that nextMessageID sorts by
+// wall-clock time first, regardless of which instance stamped it. The
+// Snowflake scheme's predecessor packed a random per-instance tag into the
+// high bits, so an instance with a small tag could mint a lower ID than one
+// with a large tag even when it sent its message later. Pinning the
+// instance IDs the "wrong" way round — the large-tagged instance sends
+// first, the small-tagged one sends after — and asserting the later send
+// still gets the larger ID is the regression test for that bug.
+func TestMessageIDOrderingAcrossInstances(t *testing.T) {
+	hubA := newHub(defaultConfig(), nil, nil)
+	hubA.instanceID = instanceIDMax // Largest possible tag, sends first.
+
+	hubB := newHub(defaultConfig(), nil, nil)
+	hubB.instanceID = 0 // Smallest possible tag, sends second.
+
+	idA := hubA.nextMessageID()
+	time.Sleep(2 * time.Millisecond) // Force a later millisecond tick.
+	idB := hubB.nextMessageID()
+
+	if idB <= idA {
+		t.Fatalf("later send by the lower-tagged instance got a smaller or equal ID: idA=%d (instance %d), idB=%d (instance %d)", idA, hubA.instanceID, idB, hubB.instanceID)
+	}
+}
+
+// TestHistorySinceAcrossInstances verifies that Since, used to replay missed
+// history on reconnect, returns a message published by one instance after a
+// cursor minted by another instance. This is the scenario chunk0-6's
+// original ID scheme broke: a reconnecting client's cursor from one
+// instance could sort higher than a later message from another instance,
+// so Since would silently drop it.
+func TestHistorySinceAcrossInstances(t *testing.T) {
+	const topic = "general"
+	store := newRingHistoryStore(defaultHistorySize)
+
+	hubA := newHub(defaultConfig(), nil, nil)
+	hubA.instanceID = instanceIDMax
+
+	hubB := newHub(defaultConfig(), nil, nil)
+	hubB.instanceID = 0
+
+	first := Message{Type: "chat", Sender: "alice", Topic: topic, Content: "hello"}
+	first.ID = hubA.nextMessageID()
+	store.Append(first)
+
+	time.Sleep(2 * time.Millisecond)
+
+	second := Message{Type: "chat", Sender: "bob", Topic: topic, Content: "hi back"}
+	second.ID = hubB.nextMessageID()
+	store.Append(second)
+
+	got := store.Since(topic, first.ID)
+	if len(got) != 1 || got[0].Content != second.Content {
+		t.Fatalf("Since(topic, %d) = %+v, want only %+v", first.ID, got, second)
+	}
+}
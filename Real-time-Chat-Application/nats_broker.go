@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/nats-io/nats.go"
+)
+
+// natsBroker implements Broker on top of NATS core pub/sub, as an
+// alternative to redisBroker for teams already running a NATS cluster.
+type natsBroker struct {
+	conn *nats.Conn
+}
+
+func newNATSBroker(url string) (*natsBroker, error) {
+	conn, err := nats.Connect(url)
+	if err != nil {
+		return nil, err
+	}
+	return &natsBroker{conn: conn}, nil
+}
+
+func (b *natsBroker) Publish(topic string, msg []byte) error {
+	return b.conn.Publish(topic, msg)
+}
+
+func (b *natsBroker) Subscribe(topic string) (<-chan []byte, error) {
+	ch := make(chan []byte, 64)
+	_, err := b.conn.Subscribe(topic, func(m *nats.Msg) {
+		ch <- m.Data
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisBroker implements Broker on top of Redis PUB/SUB, so a message
+// published on one server instance is delivered to subscribers connected
+// to any other instance sharing the same Redis server.
+type redisBroker struct {
+	client *redis.Client
+	ctx    context.Context
+}
+
+func newRedisBroker(addr string) *redisBroker {
+	return &redisBroker{
+		client: redis.NewClient(&redis.Options{Addr: addr}),
+		ctx:    context.Background(),
+	}
+}
+
+func (b *redisBroker) Publish(topic string, msg []byte) error {
+	return b.client.Publish(b.ctx, topic, msg).Err()
+}
+
+func (b *redisBroker) Subscribe(topic string) (<-chan []byte, error) {
+	pubsub := b.client.Subscribe(b.ctx, topic)
+	if _, err := pubsub.Receive(b.ctx); err != nil {
+		return nil, err
+	}
+
+	ch := make(chan []byte, 64)
+	go func() {
+		// redis.Client reconnects and re-subscribes transparently under the
+		// hood; pubsub.Channel() only closes for good when Close is called.
+		for msg := range pubsub.Channel() {
+			ch <- []byte(msg.Payload)
+		}
+		close(ch)
+	}()
+	return ch, nil
+}
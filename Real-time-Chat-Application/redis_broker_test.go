@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// TestRedisBrokerFanOutAcrossInstances verifies the behavior that makes
+// redisBroker worth having over localBroker: a message Published on one
+// instance is delivered to a Subscribe-r on a different instance, as long
+// as both share a Redis server.
+func TestRedisBrokerFanOutAcrossInstances(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	publisher := newRedisBroker(mr.Addr())
+	subscriber := newRedisBroker(mr.Addr())
+
+	ch, err := subscriber.Subscribe("general")
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	want := []byte(`{"type":"chat","content":"hello from another instance"}`)
+	if err := publisher.Publish("general", want); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	select {
+	case got := <-ch:
+		if string(got) != string(want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for message published from another instance")
+	}
+}
+
+// TestRedisBrokerReconnectSubscribe verifies that a fresh Subscribe on a new
+// redisBroker, standing in for a client reconnecting to a different
+// instance after a drop, still receives messages published afterward.
+func TestRedisBrokerReconnectSubscribe(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	publisher := newRedisBroker(mr.Addr())
+
+	first := newRedisBroker(mr.Addr())
+	if _, err := first.Subscribe("general"); err != nil {
+		t.Fatalf("Subscribe (first instance): %v", err)
+	}
+
+	// Simulate the client reconnecting through a different instance; the
+	// first instance's subscription is left open.
+	reconnected := newRedisBroker(mr.Addr())
+	ch, err := reconnected.Subscribe("general")
+	if err != nil {
+		t.Fatalf("Subscribe (reconnected instance): %v", err)
+	}
+
+	want := []byte(`{"type":"chat","content":"after reconnect"}`)
+	if err := publisher.Publish("general", want); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	select {
+	case got := <-ch:
+		if string(got) != string(want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for message after reconnect")
+	}
+}